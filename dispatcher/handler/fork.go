@@ -0,0 +1,138 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package handler
+
+import (
+	"context"
+	"sync"
+)
+
+// scope holds the state a Context shares with every Context produced by
+// its Fork: the metadata bag and the deferred-cleanup queue. Keeping it
+// behind a pointer, instead of embedding the fields directly in Context,
+// is what lets Fork'd Contexts see each other's SetValue/DeferExec calls
+// while each still has its own response slot.
+type scope struct {
+	kvMu sync.RWMutex
+	kv   map[any]any
+
+	deferMu    sync.Mutex
+	deferrable []Executable
+	sealed     uint32
+}
+
+func newScope() *scope {
+	return new(scope)
+}
+
+// setValue stores v under key in the bag. It is safe for concurrent use.
+func (s *scope) setValue(key, v any) {
+	s.kvMu.Lock()
+	defer s.kvMu.Unlock()
+	if s.kv == nil {
+		s.kv = make(map[any]any)
+	}
+	s.kv[key] = v
+}
+
+// value returns the value stored under key, if any.
+func (s *scope) value(key any) (v any, ok bool) {
+	s.kvMu.RLock()
+	defer s.kvMu.RUnlock()
+	v, ok = s.kv[key]
+	return
+}
+
+// rangeKV calls f sequentially for each key/value pair in the bag. It
+// stops if f returns false.
+func (s *scope) rangeKV(f func(key, v any) bool) {
+	s.kvMu.RLock()
+	defer s.kvMu.RUnlock()
+	for k, v := range s.kv {
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+// appendMatchedRule appends tag to the []string stored under
+// MetaKeyMatchedRules, creating it if necessary.
+func (s *scope) appendMatchedRule(tag string) {
+	s.kvMu.Lock()
+	defer s.kvMu.Unlock()
+	if s.kv == nil {
+		s.kv = make(map[any]any)
+	}
+	rules, _ := s.kv[MetaKeyMatchedRules].([]string)
+	s.kv[MetaKeyMatchedRules] = append(rules, tag)
+}
+
+// ExecutableFunc adapts a plain function to the Executable interface, so
+// closures can be registered with DeferExec without declaring a named
+// type for them.
+type ExecutableFunc func(ctx context.Context, qCtx *Context) error
+
+// Exec calls f.
+func (f ExecutableFunc) Exec(ctx context.Context, qCtx *Context) error {
+	return f(ctx, qCtx)
+}
+
+// Fork returns a child Context for a concurrent sub-query, e.g. one leg
+// of a hedged query or a race between resolvers. The child shares this
+// Context's metadata bag and deferred-cleanup scope, so a SetValue or
+// DeferExec call made by either side is visible to both, but it has its
+// own response slot, so concurrent SetResponse calls from the forked
+// legs never race with each other or with the parent.
+//
+// Fork does not register anything with the parent's defer scope by
+// itself; pair it with Join once the fan-out settles.
+func (ctx *Context) Fork() *Context {
+	return &Context{
+		q:         ctx.q,
+		from:      ctx.from,
+		id:        ctx.id,
+		startTime: ctx.startTime,
+
+		status: ContextStatusWaitingResponse,
+		s:      ctx.s,
+		span:   ctx.span,
+		goCtx:  ctx.goCtx,
+		record: ctx.record,
+	}
+}
+
+// Join collapses a set of Forked Contexts back into ctx: the first child
+// found with a ContextStatusResponded status becomes ctx's own response.
+//
+// Join does nothing with the other children's deferred cleanup, and it
+// doesn't need to: Fork gives every child the same scope as ctx, so
+// whatever a losing leg registers with DeferExec - including a leg
+// that's still in flight when Join runs, which is the whole point of a
+// hedged query - already lands in ctx's own queue and is drained by
+// ctx's ExecDefer. That also means callers must not call ExecDefer until
+// every forked leg is done registering its own cleanup; a straggler
+// that calls DeferExec after the shared queue is sealed will panic, the
+// same as it would on any other shared Context.
+func (ctx *Context) Join(children ...*Context) {
+	for _, child := range children {
+		if child.Status() == ContextStatusResponded {
+			ctx.SetResponse(child.R(), child.Status())
+			return
+		}
+	}
+}
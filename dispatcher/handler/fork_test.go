@@ -0,0 +1,146 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package handler
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func testQuery() *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	return m
+}
+
+// TestDeferExecSealing exercises the guarantee chunk0-3 added: DeferExec
+// can be called from many goroutines while the query is in flight, and
+// ExecDefer runs the whole queue exactly once even if called concurrently
+// itself.
+func TestDeferExecSealing(t *testing.T) {
+	ctx := NewContext(testQuery(), nil)
+
+	const n = 8
+	var ran int32
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx.DeferExec(ExecutableFunc(func(_ context.Context, _ *Context) error {
+				atomic.AddInt32(&ran, 1)
+				return nil
+			}))
+		}()
+	}
+	wg.Wait()
+
+	var execWg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		execWg.Add(1)
+		go func() {
+			defer execWg.Done()
+			if err := ctx.ExecDefer(context.Background()); err != nil {
+				t.Errorf("ExecDefer: %v", err)
+			}
+		}()
+	}
+	execWg.Wait()
+
+	if got := atomic.LoadInt32(&ran); got != n {
+		t.Fatalf("expected %d deferred executables to run exactly once, got %d", n, got)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected DeferExec after ExecDefer has sealed the queue to panic")
+			}
+		}()
+		ctx.DeferExec(ExecutableFunc(func(_ context.Context, _ *Context) error { return nil }))
+	}()
+}
+
+// TestForkJoin exercises Context.Fork/Join: forked legs share the
+// metadata bag, Join adopts the responded leg's response, and a losing
+// leg's cleanup, registered in the shared defer scope, runs on the
+// parent's ExecDefer.
+func TestForkJoin(t *testing.T) {
+	ctx := NewContext(testQuery(), nil)
+
+	winner := ctx.Fork()
+	winnerResp := new(dns.Msg)
+	winnerResp.SetReply(testQuery())
+	winner.SetResponse(winnerResp, ContextStatusResponded)
+
+	loser := ctx.Fork()
+	var loserCleanedUp int32
+	loser.DeferExec(ExecutableFunc(func(_ context.Context, _ *Context) error {
+		atomic.AddInt32(&loserCleanedUp, 1)
+		return nil
+	}))
+	loser.SetResponse(nil, ContextStatusServerFailed)
+
+	winner.SetValue("k", "v")
+	if v, ok := loser.Value("k"); !ok || v != "v" {
+		t.Fatalf("expected Fork'd Contexts to share the metadata bag, got %v, %v", v, ok)
+	}
+
+	ctx.Join(winner, loser)
+
+	if ctx.R() != winnerResp {
+		t.Fatal("Join did not adopt the responded child's response")
+	}
+	if ctx.Status() != ContextStatusResponded {
+		t.Fatalf("Join did not adopt the responded child's status, got %v", ctx.Status())
+	}
+
+	if err := ctx.ExecDefer(context.Background()); err != nil {
+		t.Fatalf("ExecDefer: %v", err)
+	}
+	if atomic.LoadInt32(&loserCleanedUp) != 1 {
+		t.Fatal("expected the parent's ExecDefer to run the losing leg's deferred cleanup")
+	}
+}
+
+// TestCopyRecordIndependence exercises Context.Copy: the copy's Record
+// must read and write the copy's own metadata bag, never the original's.
+func TestCopyRecordIndependence(t *testing.T) {
+	ctx := NewContext(testQuery(), nil)
+	ctx.Record().SetUpstream("original")
+
+	cp := ctx.Copy()
+
+	cp.SetValue(MetaKeyUpstream, "from-bag")
+	if got := cp.Record().Upstream(); got != "from-bag" {
+		t.Fatalf("expected cp.Record() to see cp's own bag, got %q", got)
+	}
+
+	cp.Record().SetUpstream("from-record")
+	if got, _ := cp.Value(MetaKeyUpstream); got != "from-record" {
+		t.Fatalf("expected cp.Value to see cp.Record()'s write, got %v", got)
+	}
+
+	if got := ctx.Record().Upstream(); got != "original" {
+		t.Fatalf("expected Copy to leave the original's record untouched, got %q", got)
+	}
+}
@@ -0,0 +1,75 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package handler
+
+// MetaKey is the type of the well-known keys below. Plugins that define
+// their own per-query annotations should use a package-private type for
+// their keys, not MetaKey or a plain string, to avoid collisions in
+// Context's metadata bag.
+type MetaKey string
+
+// Well-known metadata keys that built-in plugins read from and write to
+// via Context.SetValue/Context.Value. Third-party plugins may use these
+// too, so that e.g. a cache plugin can branch on the upstream a forward
+// plugin picked, or a logger can print the ECS decision made earlier in
+// the sequence. These are also the keys Context.Record's mirrored
+// setters/getters (SetUpstream, SetCacheStatus, ...) read and write, so
+// the bag stays the single source of truth for both branching and
+// logging.
+const (
+	// MetaKeyUpstream records the tag/address of the upstream that
+	// produced the response (set by forward-like plugins).
+	MetaKeyUpstream MetaKey = "upstream"
+
+	// MetaKeyCacheStatus records whether the response was served from
+	// cache. See CacheStatus for the expected value type.
+	MetaKeyCacheStatus MetaKey = "cache_status"
+
+	// MetaKeyECSUsed records the EDNS Client Subnet decision made for the
+	// outgoing query: the subnet string if one was attached, or a bool if
+	// a plugin only needs to record that ECS was stripped/skipped.
+	MetaKeyECSUsed MetaKey = "ecs_used"
+
+	// MetaKeyMatchedRules records the ordered tags of the rules that
+	// matched this query, for plugins (e.g. "if") that branch on a
+	// decision made earlier in the sequence. Stored as []string.
+	MetaKeyMatchedRules MetaKey = "matched_rules"
+)
+
+// CacheStatus is the value type stored under MetaKeyCacheStatus.
+type CacheStatus uint8
+
+const (
+	CacheStatusMiss CacheStatus = iota
+	CacheStatusHit
+	CacheStatusStale
+)
+
+var cacheStatusToStr = map[CacheStatus]string{
+	CacheStatusMiss:  "miss",
+	CacheStatusHit:   "hit",
+	CacheStatusStale: "stale",
+}
+
+func (s CacheStatus) String() string {
+	str, ok := cacheStatusToStr[s]
+	if ok {
+		return str
+	}
+	return "invalid cache status"
+}
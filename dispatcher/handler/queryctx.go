@@ -21,6 +21,9 @@ import (
 	"context"
 	"fmt"
 	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"net"
 	"sync/atomic"
@@ -34,15 +37,25 @@ type Context struct {
 	// init at beginning
 	q         *dns.Msg
 	from      net.Addr
-	info      string // a short Context summary for logging
 	id        uint32 // additional uint to distinguish duplicated msg
 	startTime time.Time
 
 	status ContextStatus
 	r      *dns.Msg
 
-	deferrable  []Executable
-	deferAtomic uint32
+	// record accumulates this query's structured log record: matched
+	// rules, upstream, cache status, per-stage latency, and so on.
+	record *QueryRecord
+
+	// s is the state shared with every Context produced by Fork. It
+	// carries the metadata bag and the deferred-cleanup queue.
+	s *scope
+
+	span trace.Span // root span for this query, always non-nil
+
+	// goCtx is the context.Context this query is bound to. It is never
+	// nil; NewContext binds it to context.Background().
+	goCtx context.Context
 }
 
 type ContextStatus uint8
@@ -76,10 +89,26 @@ var id uint32
 // NewContext creates a new query Context.
 // q is the query dns msg. it cannot be nil, or NewContext will panic.
 // from is the client net.Addr. It can be nil.
+// The returned Context is bound to context.Background(). Use
+// NewContextWithCtx to bind it to a cancellable/deadline-bound
+// context.Context instead, e.g. one tied to the client connection.
 func NewContext(q *dns.Msg, from net.Addr) *Context {
+	return NewContextWithCtx(q, from, context.Background())
+}
+
+// NewContextWithCtx creates a new query Context bound to goCtx. goCtx's
+// cancellation and deadline are what Context.Done and Context.Deadline
+// report, and it should be propagated into every plugin invocation and
+// Executable.Exec call made for this query, so the whole query unwinds
+// promptly once goCtx is done (e.g. the client walked away).
+// q cannot be nil, or NewContextWithCtx will panic. goCtx cannot be nil.
+func NewContextWithCtx(q *dns.Msg, from net.Addr, goCtx context.Context) *Context {
 	if q == nil {
 		panic("handler: query msg is nil")
 	}
+	if goCtx == nil {
+		panic("handler: goCtx is nil")
+	}
 
 	ctx := &Context{
 		q:         q,
@@ -88,16 +117,86 @@ func NewContext(q *dns.Msg, from net.Addr) *Context {
 		startTime: time.Now(),
 
 		status: ContextStatusWaitingResponse,
+		s:      newScope(),
+		goCtx:  goCtx,
 	}
+	ctx.record = newQueryRecord(from, ctx.s)
+
+	_, ctx.span = Tracer().Start(goCtx, "query", trace.WithAttributes(questionAttrs(q)...))
+
+	return ctx
+}
+
+// GoCtx returns the context.Context this query is bound to. It is never
+// nil. Plugins that need a cancellable/deadline-bound context for an
+// upstream call, a cache fill, or a hosts-file lookup should derive from
+// this instead of manufacturing their own context.WithTimeout unrelated
+// to the query's lifecycle.
+func (ctx *Context) GoCtx() context.Context {
+	return ctx.goCtx
+}
+
+// Deadline returns the deadline of the bound context.Context, if any.
+func (ctx *Context) Deadline() (deadline time.Time, ok bool) {
+	return ctx.goCtx.Deadline()
+}
 
-	if len(q.Question) == 1 {
-		q := q.Question[0]
-		ctx.info = fmt.Sprintf("%s %d %d %d %d", q.Name, q.Qtype, q.Qclass, ctx.q.Id, ctx.id)
+// Done returns a channel that's closed when the bound context.Context is
+// done, e.g. because the client that sent this query disconnected or its
+// request timed out.
+func (ctx *Context) Done() <-chan struct{} {
+	return ctx.goCtx.Done()
+}
+
+// Tracer returns a trace.Tracer, ready for creating spans related to the
+// query lifecycle. Plugins that do their own tracing should call
+// Context.StartSpan instead, so the span is properly parented.
+func Tracer() trace.Tracer {
+	return otelTracerValue.Load().(tracerHolder).tracer
+}
+
+// StartSpan starts a child span of this Context's root span, tagged with
+// the calling plugin's tag. It returns a context.Context carrying the new
+// span, to be passed down to cCtx-accepting calls (e.g. Executable.Exec),
+// and the span itself so the caller can set attributes/status and End it.
+func (ctx *Context) StartSpan(cCtx context.Context, plugin string) (context.Context, trace.Span) {
+	return Tracer().Start(
+		trace.ContextWithSpan(cCtx, ctx.span),
+		plugin,
+		trace.WithAttributes(attribute.String("plugin", plugin)),
+	)
+}
+
+// EndQuerySpan ends this Context's root span, recording the final Status
+// and, if there is a response, its response code before doing so.
+// The span status is set to Error for a failed/dropped/rejected query or
+// a non-success rcode, and to Ok otherwise, so a trace backend filtering
+// or alerting on span status can surface failed queries.
+// It must be called exactly once, after the query has been fully handled.
+func (ctx *Context) EndQuerySpan() {
+	failed := ctx.status != ContextStatusResponded
+	if ctx.r != nil {
+		ctx.span.SetAttributes(attribute.String("rcode", dns.RcodeToString[ctx.r.Rcode]))
+		failed = failed || ctx.r.Rcode != dns.RcodeSuccess
+	}
+	ctx.span.SetAttributes(attribute.String("status", ctx.status.String()))
+	if failed {
+		ctx.span.SetStatus(codes.Error, ctx.status.String())
 	} else {
-		ctx.info = fmt.Sprintf("%v %d %d", ctx.q.Question, ctx.id, ctx.q.Id)
+		ctx.span.SetStatus(codes.Ok, "")
 	}
+	ctx.span.End()
+}
 
-	return ctx
+func questionAttrs(q *dns.Msg) []attribute.KeyValue {
+	if len(q.Question) != 1 {
+		return []attribute.KeyValue{attribute.Int("question_count", len(q.Question))}
+	}
+	question := q.Question[0]
+	return []attribute.KeyValue{
+		attribute.String("name", question.Name),
+		attribute.String("qtype", dns.TypeToString[question.Qtype]),
+	}
 }
 
 // Q returns the query msg. It always returns a non-nil msg.
@@ -125,34 +224,72 @@ func (ctx *Context) SetResponse(r *dns.Msg, status ContextStatus) {
 
 // CopyDeferFrom copies defer Executable from other Context.
 func (ctx *Context) CopyDeferFrom(src *Context) {
-	ctx.deferrable = make([]Executable, len(src.deferrable))
-	copy(ctx.deferrable, src.deferrable)
+	src.s.deferMu.Lock()
+	defer src.s.deferMu.Unlock()
+	ctx.s.deferrable = make([]Executable, len(src.s.deferrable))
+	copy(ctx.s.deferrable, src.s.deferrable)
 }
 
-// DeferExec registers an deferred Executable at this Context.
+// DeferExec registers a deferred Executable. It is safe to call from
+// multiple goroutines sharing this Context (e.g. the legs of a Fork'd
+// fan-out), as long as ExecDefer hasn't run yet; DeferExec panics if
+// called after ExecDefer has sealed the queue.
 func (ctx *Context) DeferExec(e Executable) {
-	if i := atomic.LoadUint32(&ctx.deferAtomic); i == 1 {
-		panic("handler Context: concurrent ExecDefer or DeferExec")
+	ctx.s.deferMu.Lock()
+	defer ctx.s.deferMu.Unlock()
+	if atomic.LoadUint32(&ctx.s.sealed) == 1 {
+		panic("handler Context: DeferExec called after ExecDefer")
 	}
-	ctx.deferrable = append(ctx.deferrable, e)
+	ctx.s.deferrable = append(ctx.s.deferrable, e)
 }
 
-// ExecDefer executes all deferred Executable registered by DeferExec.
+// deferFallbackTimeout bounds the context ExecDefer substitutes in when
+// the one it was given is already done, so log/stat writers registered
+// via DeferExec still get a chance to run instead of being skipped.
+const deferFallbackTimeout = 5 * time.Second
+
+// ExecDefer seals the deferred-cleanup queue and runs every registered
+// Executable exactly once, in LIFO order. It is safe to call concurrently
+// or more than once: only the first caller runs the queue, every other
+// call is a no-op that returns nil immediately. An Executable that fails
+// does not stop the ones after it; ExecDefer returns the first error.
+//
+// If cCtx is already done (the query was cancelled), ExecDefer still
+// runs the queue, but against a fresh context bounded by
+// deferFallbackTimeout instead of the dead one.
 func (ctx *Context) ExecDefer(cCtx context.Context) error {
-	if ok := atomic.CompareAndSwapUint32(&ctx.deferAtomic, 0, 1); !ok {
-		panic("handler Context: concurrent ExecDefer or DeferExec")
+	if !atomic.CompareAndSwapUint32(&ctx.s.sealed, 0, 1) {
+		return nil
+	}
+
+	if cCtx.Err() != nil {
+		var cancel context.CancelFunc
+		cCtx, cancel = context.WithTimeout(context.Background(), deferFallbackTimeout)
+		defer cancel()
 	}
-	defer atomic.CompareAndSwapUint32(&ctx.deferAtomic, 1, 0)
 
-	for range ctx.deferrable {
-		executable := ctx.deferrable[len(ctx.deferrable)-1]
-		ctx.deferrable[len(ctx.deferrable)-1] = nil
-		ctx.deferrable = ctx.deferrable[0 : len(ctx.deferrable)-1]
-		if err := executable.Exec(cCtx, ctx); err != nil {
-			return err
+	ctx.s.deferMu.Lock()
+	deferred := ctx.s.deferrable
+	ctx.s.deferrable = nil
+	ctx.s.deferMu.Unlock()
+
+	var firstErr error
+	for i := len(deferred) - 1; i >= 0; i-- {
+		executable := deferred[i]
+
+		spanCtx, span := ctx.StartSpan(cCtx, "defer")
+		err := executable.Exec(spanCtx, ctx)
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		} else {
+			span.SetStatus(codes.Ok, "")
+		}
+		span.End()
+		if err != nil && firstErr == nil {
+			firstErr = err
 		}
 	}
-	return nil
+	return firstErr
 }
 
 // Id returns the Context id.
@@ -167,10 +304,67 @@ func (ctx *Context) StartTime() time.Time {
 	return ctx.startTime
 }
 
-// InfoField returns a zap.Field.
-// Just for convenience.
+// InfoField returns a zap.Field with a short summary of this query.
+// Just for convenience. See InfoFields for the full structured record.
 func (ctx *Context) InfoField() zap.Field {
-	return zap.String("query", ctx.info)
+	var info string
+	if len(ctx.q.Question) == 1 {
+		q := ctx.q.Question[0]
+		info = fmt.Sprintf("%s %d %d %d %d", q.Name, q.Qtype, q.Qclass, ctx.q.Id, ctx.id)
+	} else {
+		info = fmt.Sprintf("%v %d %d", ctx.q.Question, ctx.id, ctx.q.Id)
+	}
+	return zap.String("query", info)
+}
+
+// Record returns this query's QueryRecord, for plugins to annotate as
+// the query moves through the chain (matched rules, upstream, cache
+// status, per-stage latency...).
+func (ctx *Context) Record() *QueryRecord {
+	return ctx.record
+}
+
+// InfoFields renders the whole QueryRecord, plus the question and the
+// Context's own ids, as a slice of zap.Field, so a caller can emit one
+// structured log line per query instead of grepping across the dozens
+// of debug lines each plugin used to produce on its own.
+func (ctx *Context) InfoFields() []zap.Field {
+	fields := []zap.Field{
+		zap.Uint32("id", ctx.id),
+		zap.Uint16("qid", ctx.q.Id),
+	}
+	if len(ctx.q.Question) == 1 {
+		q := ctx.q.Question[0]
+		fields = append(fields,
+			zap.String("qname", q.Name),
+			zap.String("qtype", dns.TypeToString[q.Qtype]),
+		)
+	} else {
+		fields = append(fields, zap.Int("question_count", len(ctx.q.Question)))
+	}
+
+	fields = append(fields, ctx.record.fields()...)
+	fields = append(fields, zap.Duration("elapsed", time.Since(ctx.startTime)))
+	return fields
+}
+
+// SetValue stores v under key in this Context's metadata bag.
+// It is safe for concurrent use. A nil key is not allowed.
+func (ctx *Context) SetValue(key, v any) {
+	ctx.s.setValue(key, v)
+}
+
+// Value returns the value stored under key by a previous SetValue call.
+// ok is false if key was never set.
+func (ctx *Context) Value(key any) (v any, ok bool) {
+	return ctx.s.value(key)
+}
+
+// Range calls f sequentially for each key/value pair in the metadata bag.
+// Range stops the iteration if f returns false. f must not call SetValue,
+// as it would deadlock.
+func (ctx *Context) Range(f func(key, v any) bool) {
+	ctx.s.rangeKV(f)
 }
 
 // Copy deep copies this Context.
@@ -181,7 +375,6 @@ func (ctx *Context) Copy() *Context {
 
 	newCtx.q = ctx.q.Copy()
 	newCtx.from = ctx.from
-	newCtx.info = ctx.info
 	newCtx.id = ctx.id
 	newCtx.startTime = ctx.startTime
 
@@ -190,5 +383,23 @@ func (ctx *Context) Copy() *Context {
 		newCtx.r = ctx.r.Copy()
 	}
 
+	newCtx.span = ctx.span
+	newCtx.goCtx = ctx.goCtx
+	newCtx.s = newScope()
+
+	ctx.s.kvMu.RLock()
+	if len(ctx.s.kv) > 0 {
+		newCtx.s.kv = make(map[any]any, len(ctx.s.kv))
+		for k, v := range ctx.s.kv {
+			newCtx.s.kv[k] = v
+		}
+	}
+	ctx.s.kvMu.RUnlock()
+
+	// record must be rebound to newCtx.s, not ctx.s: otherwise the copy's
+	// Record() would silently read and write the original Context's bag
+	// instead of its own.
+	newCtx.record = ctx.record.copyWith(newCtx.s)
+
 	return newCtx
 }
@@ -0,0 +1,261 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// rcodeToString renders rcode using dns's well-known names, falling back
+// to the numeric value for anything it doesn't recognize.
+func rcodeToString(rcode int) string {
+	if s, ok := dns.RcodeToString[rcode]; ok {
+		return s
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+// StageLatency records how long a single named stage of query processing
+// (a plugin tag, "cache", "forward", ...) took.
+type StageLatency struct {
+	Stage    string        `json:"stage"`
+	Duration time.Duration `json:"duration"`
+}
+
+// QueryRecord accumulates everything about a single query's trip through
+// the plugin chain: the client, the ECS decision, the rules it matched,
+// the upstream that answered, the cache status, and per-stage latency.
+// It is safe for concurrent use, so a sequence plugin fanning a query
+// out to several goroutines (see Context.Fork) can all annotate it.
+//
+// The ECS/upstream/cache-status/matched-rules fields are not stored
+// locally: QueryRecord is a view over the same metadata bag SetValue and
+// Value read and write (see MetaKeyUpstream and friends in metakey.go).
+// That keeps the bag the single source of truth, so a plugin that wants
+// one of these fields logged via SetUpstream also gets it back from
+// Value(MetaKeyUpstream) for branching, and vice versa.
+//
+// A Context's QueryRecord is obtained with Context.Record; the whole
+// thing is rendered as one structured log line by Context.InfoFields,
+// or written to a JSONLSink for offline analysis.
+type QueryRecord struct {
+	s *scope
+
+	clientAddr net.Addr
+
+	mu     sync.Mutex
+	stages []StageLatency
+
+	hasFinal    bool
+	rcode       int
+	answerCount int
+}
+
+func newQueryRecord(from net.Addr, s *scope) *QueryRecord {
+	return &QueryRecord{clientAddr: from, s: s}
+}
+
+// copyWith returns a copy of r bound to s instead of r's own scope, for
+// Context.Copy: the copy's record must read and write the copy's bag,
+// not the original Context's.
+func (r *QueryRecord) copyWith(s *scope) *QueryRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return &QueryRecord{
+		s:           s,
+		clientAddr:  r.clientAddr,
+		stages:      append([]StageLatency(nil), r.stages...),
+		hasFinal:    r.hasFinal,
+		rcode:       r.rcode,
+		answerCount: r.answerCount,
+	}
+}
+
+// AddMatchedRule appends tag to the ordered list of rules that matched
+// this query, stored under MetaKeyMatchedRules.
+func (r *QueryRecord) AddMatchedRule(tag string) {
+	r.s.appendMatchedRule(tag)
+}
+
+// MatchedRules returns the ordered list of rules that matched this query.
+func (r *QueryRecord) MatchedRules() []string {
+	v, _ := r.s.value(MetaKeyMatchedRules)
+	rules, _ := v.([]string)
+	return rules
+}
+
+// SetUpstream records the upstream tag/address that produced the
+// response, under MetaKeyUpstream.
+func (r *QueryRecord) SetUpstream(upstream string) {
+	r.s.setValue(MetaKeyUpstream, upstream)
+}
+
+// Upstream returns the upstream tag/address recorded by SetUpstream.
+func (r *QueryRecord) Upstream() string {
+	v, _ := r.s.value(MetaKeyUpstream)
+	upstream, _ := v.(string)
+	return upstream
+}
+
+// SetECSSubnet records the ECS subnet attached to (or stripped from) the
+// outgoing query, under MetaKeyECSUsed.
+func (r *QueryRecord) SetECSSubnet(subnet string) {
+	r.s.setValue(MetaKeyECSUsed, subnet)
+}
+
+// ECSSubnet returns the ECS subnet recorded by SetECSSubnet.
+func (r *QueryRecord) ECSSubnet() string {
+	v, _ := r.s.value(MetaKeyECSUsed)
+	subnet, _ := v.(string)
+	return subnet
+}
+
+// SetCacheStatus records whether the response was served from cache,
+// under MetaKeyCacheStatus.
+func (r *QueryRecord) SetCacheStatus(status CacheStatus) {
+	r.s.setValue(MetaKeyCacheStatus, status)
+}
+
+// CacheStatus returns the cache status recorded by SetCacheStatus.
+func (r *QueryRecord) CacheStatus() CacheStatus {
+	v, _ := r.s.value(MetaKeyCacheStatus)
+	status, _ := v.(CacheStatus)
+	return status
+}
+
+// AddStageLatency appends the duration a named processing stage took.
+func (r *QueryRecord) AddStageLatency(stage string, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stages = append(r.stages, StageLatency{Stage: stage, Duration: d})
+}
+
+// SetFinal records the final response code and answer count. It is
+// normally called once, right before the record is logged.
+func (r *QueryRecord) SetFinal(rcode, answerCount int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hasFinal = true
+	r.rcode = rcode
+	r.answerCount = answerCount
+}
+
+// fields renders the record as zap.Field, omitting anything that was
+// never set, except cache_status, which is always present (a cache status
+// that was never set renders as "miss").
+func (r *QueryRecord) fields() []zap.Field {
+	fields := make([]zap.Field, 0, 8)
+	if r.clientAddr != nil {
+		fields = append(fields, zap.Stringer("client", r.clientAddr))
+	}
+	if ecsSubnet := r.ECSSubnet(); len(ecsSubnet) > 0 {
+		fields = append(fields, zap.String("ecs_subnet", ecsSubnet))
+	}
+	if matchedRules := r.MatchedRules(); len(matchedRules) > 0 {
+		fields = append(fields, zap.Strings("matched_rules", matchedRules))
+	}
+	if upstream := r.Upstream(); len(upstream) > 0 {
+		fields = append(fields, zap.String("upstream", upstream))
+	}
+	fields = append(fields, zap.Stringer("cache_status", r.CacheStatus()))
+
+	r.mu.Lock()
+	stages := r.stages
+	hasFinal, rcode, answerCount := r.hasFinal, r.rcode, r.answerCount
+	r.mu.Unlock()
+
+	for _, s := range stages {
+		fields = append(fields, zap.Duration("stage_"+s.Stage, s.Duration))
+	}
+	if hasFinal {
+		fields = append(fields, zap.String("rcode", rcodeToString(rcode)), zap.Int("answer_count", answerCount))
+	}
+	return fields
+}
+
+// queryRecordJSON is the JSON-Lines wire shape of a QueryRecord.
+type queryRecordJSON struct {
+	ClientAddr   string         `json:"client_addr,omitempty"`
+	ECSSubnet    string         `json:"ecs_subnet,omitempty"`
+	MatchedRules []string       `json:"matched_rules,omitempty"`
+	Upstream     string         `json:"upstream,omitempty"`
+	CacheStatus  string         `json:"cache_status"`
+	Stages       []StageLatency `json:"stages,omitempty"`
+	RCode        string         `json:"rcode,omitempty"`
+	AnswerCount  int            `json:"answer_count,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler, for writing a QueryRecord to a
+// JSONLSink.
+func (r *QueryRecord) MarshalJSON() ([]byte, error) {
+	out := queryRecordJSON{
+		ECSSubnet:    r.ECSSubnet(),
+		MatchedRules: r.MatchedRules(),
+		Upstream:     r.Upstream(),
+		CacheStatus:  r.CacheStatus().String(),
+	}
+	if r.clientAddr != nil {
+		out.ClientAddr = r.clientAddr.String()
+	}
+
+	r.mu.Lock()
+	out.Stages = r.stages
+	if r.hasFinal {
+		out.RCode = rcodeToString(r.rcode)
+		out.AnswerCount = r.answerCount
+	}
+	r.mu.Unlock()
+
+	return json.Marshal(out)
+}
+
+// JSONLSink writes QueryRecords as newline-delimited JSON, for offline
+// analysis (tailing into jq, loading into a notebook, ...). It does not
+// buffer: every WriteRecord call is a single io.Writer.Write.
+type JSONLSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONLSink wraps w as a JSONLSink.
+func NewJSONLSink(w io.Writer) *JSONLSink {
+	return &JSONLSink{w: w}
+}
+
+// WriteRecord marshals rec as one JSON object and writes it to the sink
+// followed by a newline.
+func (s *JSONLSink) WriteRecord(rec *QueryRecord) error {
+	b, err := rec.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(b)
+	return err
+}
@@ -0,0 +1,123 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies this package as an OpenTelemetry
+// instrumentation library.
+const instrumentationName = "github.com/IrineSistiana/mosdns/dispatcher/handler"
+
+// tracerHolder boxes a trace.Tracer so it can be stored in an
+// atomic.Value: every Store must use the same concrete type, and
+// tp.Tracer's concrete type differs between providers.
+type tracerHolder struct {
+	tracer trace.Tracer
+}
+
+// otelTracerValue holds the tracerHolder used by all Context spans. It
+// defaults to a no-op tracer until TracingConfig.Apply registers a real
+// provider, so Context-level tracing is always safe to call, even if
+// tracing was never configured. It's an atomic.Value, not a bare var,
+// because mosdns reloads config live: Apply can run concurrently with
+// Tracer()/NewContextWithCtx calls for in-flight queries.
+var otelTracerValue atomic.Value
+
+func init() {
+	otelTracerValue.Store(tracerHolder{tracer: otel.Tracer(instrumentationName)})
+}
+
+// TracingExporter selects which span exporter TracingConfig.Apply wires
+// up the global TracerProvider with.
+type TracingExporter string
+
+const (
+	// TracingExporterStdout writes spans as human-readable text to
+	// stdout. Useful for local debugging.
+	TracingExporterStdout TracingExporter = "stdout"
+	// TracingExporterOTLPGRPC ships spans to an OTLP/gRPC collector.
+	TracingExporterOTLPGRPC TracingExporter = "otlp_grpc"
+)
+
+// TracingConfig configures the OpenTelemetry TracerProvider that backs
+// every Context's query span. The zero value leaves tracing disabled
+// (Apply is a no-op), so operators that don't care about tracing pay no
+// cost beyond a no-op Tracer.
+type TracingConfig struct {
+	Enable   bool            `yaml:"enable"`
+	Exporter TracingExporter `yaml:"exporter"` // "stdout" or "otlp_grpc", default "stdout"
+	Endpoint string          `yaml:"endpoint"` // otlp_grpc collector address, e.g. "localhost:4317"
+	Insecure bool            `yaml:"insecure"` // otlp_grpc: disable TLS
+}
+
+// Apply builds a TracerProvider from cfg and installs it as the global
+// provider used by Context. It returns a shutdown func that flushes and
+// closes the exporter; callers should defer it on program exit. If
+// cfg.Enable is false, Apply returns a no-op shutdown func and leaves
+// the default no-op tracer in place.
+func (cfg TracingConfig) Apply(ctx context.Context) (shutdown func(context.Context) error, err error) {
+	if !cfg.Enable {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := cfg.newExporter(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("handler: failed to init trace exporter: %w", err)
+	}
+
+	res, err := resource.New(ctx, resource.WithAttributes(semconv.ServiceNameKey.String("mosdns")))
+	if err != nil {
+		return nil, fmt.Errorf("handler: failed to init trace resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	otelTracerValue.Store(tracerHolder{tracer: tp.Tracer(instrumentationName)})
+
+	return tp.Shutdown, nil
+}
+
+func (cfg TracingConfig) newExporter(ctx context.Context) (sdktrace.SpanExporter, error) {
+	switch cfg.Exporter {
+	case "", TracingExporterStdout:
+		return stdouttrace.New()
+	case TracingExporterOTLPGRPC:
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+}